@@ -1,50 +1,266 @@
 package store
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	api "github.com/hashicorp/consul/api"
 )
 
+const (
+	// defaultLockTTL is the session TTL used when LockOptions.TTL is unset
+	defaultLockTTL = 20 * time.Second
+
+	// defaultRenewPeriod is the renewal interval used when
+	// LockOptions.RenewPeriod is unset
+	defaultRenewPeriod = defaultLockTTL / 3
+
+	// RenewSessionRetryMax is the number of consecutive renewal failures
+	// tolerated before the renewal goroutine gives up on a session
+	RenewSessionRetryMax = 5
+
+	// MaxSessionDestroyAttempts is the number of times Release retries
+	// Destroy on transient failures before giving up
+	MaxSessionDestroyAttempts = 5
+)
+
 var (
 	// ErrSessionUndefined is exported
 	ErrSessionUndefined = errors.New("Session does not exist")
+
+	// ErrSessionRenew is returned when a lock session cannot be created,
+	// which can happen against older Consul versions that do not
+	// support sessions
+	ErrSessionRenew = errors.New("Cannot create Consul session, sessions may not be supported by this Consul version")
+
+	// ErrTxFailed is returned when a Tx is rejected because one or
+	// more of its staged checks did not hold
+	ErrTxFailed = errors.New("Transaction failed, one or more operations could not be applied")
+
+	// ErrMultipleEndpointsUnsupported is returned by backends that
+	// cannot route a single client across more than one endpoint,
+	// instead of silently using only the first one given
+	ErrMultipleEndpointsUnsupported = errors.New("This backend does not support multiple endpoints")
 )
 
 // Consul embeds the client and watches/lock sessions
 type Consul struct {
-	config   *api.Config
-	client   *api.Client
-	sessions map[string]*api.Session
+	config  *api.Config
+	client  *api.Client
+	options ConsulOptions
+
+	mu       sync.Mutex // guards sessions and watches
+	sessions map[string]*sessionLock
 	watches  map[string]*Watch
 }
 
+// sessionLock tracks a lock's Consul session along with the channel
+// used to stop its background renewal goroutine
+type sessionLock struct {
+	session *api.Session
+	doneCh  chan struct{}
+}
+
+// LockOptions contains the optional parameters used to acquire a lock
+type LockOptions struct {
+	TTL         time.Duration // Session TTL, defaults to defaultLockTTL
+	RenewPeriod time.Duration // Renewal interval, defaults to TTL/3
+	LockDelay   time.Duration // Consul lock-delay applied after the session is invalidated
+}
+
 // Watch embeds the event channel and the
 // refresh interval
 type Watch struct {
 	LastIndex uint64
 	Interval  time.Duration
 	EventChan interface{}
+	cancel    context.CancelFunc
+}
+
+// Consistency selects the read consistency mode for a call
+type Consistency string
+
+const (
+	// ConsistencyDefault lets Consul apply its own default consistency mode
+	ConsistencyDefault Consistency = ""
+	// ConsistencyStale allows any server to answer a read, trading
+	// consistency for lower latency and availability during elections
+	ConsistencyStale Consistency = "stale"
+	// ConsistencyConsistent forwards the request to the leader and
+	// confirms it with a quorum before answering
+	ConsistencyConsistent Consistency = "consistent"
+)
+
+// ConsulOptions configures per-client defaults: ACL token, datacenter,
+// namespace, read consistency and endpoint failover. Pass it to
+// InitializeConsul/SetOptions alongside *tls.Config and time.Duration.
+type ConsulOptions struct {
+	Token       string
+	Datacenter  string
+	Namespace   string
+	Consistency Consistency
+	Endpoints   []string
+}
+
+// CallOption overrides one of ConsulOptions' fields for a single call
+type CallOption func(*callConfig)
+
+// WithToken overrides the ACL token for a single call
+func WithToken(token string) CallOption {
+	return func(c *callConfig) { c.token = token }
+}
+
+// WithDatacenter targets a single call at a specific datacenter
+func WithDatacenter(datacenter string) CallOption {
+	return func(c *callConfig) { c.datacenter = datacenter }
+}
+
+// WithNamespace targets a single call at a specific Consul Enterprise namespace
+func WithNamespace(namespace string) CallOption {
+	return func(c *callConfig) { c.namespace = namespace }
+}
+
+// WithConsistency overrides the read consistency mode for a single call
+func WithConsistency(consistency Consistency) CallOption {
+	return func(c *callConfig) { c.consistency = consistency }
+}
+
+// callConfig is the resolved set of per-call parameters, seeded from
+// ConsulOptions and then overridden by any CallOptions passed in
+type callConfig struct {
+	token       string
+	datacenter  string
+	namespace   string
+	consistency Consistency
+}
+
+func (s *Consul) callConfig(opts ...CallOption) *callConfig {
+	c := &callConfig{
+		token:       s.options.Token,
+		datacenter:  s.options.Datacenter,
+		namespace:   s.options.Namespace,
+		consistency: s.options.Consistency,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// queryOptions builds Consul QueryOptions from ctx and c, mapping a
+// context deadline into WaitTime so long-polling calls unblock on
+// their own once the context expires instead of waiting for Consul
+// to reply
+func (c *callConfig) queryOptions(ctx context.Context, base *api.QueryOptions) *api.QueryOptions {
+	if base == nil {
+		base = &api.QueryOptions{}
+	}
+	base.Token = c.token
+	base.Datacenter = c.datacenter
+	base.Namespace = c.namespace
+	switch c.consistency {
+	case ConsistencyStale:
+		base.AllowStale = true
+	case ConsistencyConsistent:
+		base.RequireConsistent = true
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if wait := time.Until(deadline); wait > 0 && (base.WaitTime == 0 || wait < base.WaitTime) {
+			base.WaitTime = wait
+		}
+	}
+	return base.WithContext(ctx)
+}
+
+// writeOptions builds Consul WriteOptions from ctx and c
+func (c *callConfig) writeOptions(ctx context.Context) *api.WriteOptions {
+	opts := &api.WriteOptions{
+		Token:      c.token,
+		Datacenter: c.datacenter,
+		Namespace:  c.namespace,
+	}
+	return opts.WithContext(ctx)
+}
+
+// endpointRotator is an http.RoundTripper that rotates through a list
+// of Consul endpoints, retrying the next one when a request fails
+// with a connection-level error instead of always hitting endpoints[0]
+type endpointRotator struct {
+	next      http.RoundTripper
+	endpoints []string
+
+	mu    sync.Mutex
+	index int
+}
+
+func newEndpointRotator(next http.RoundTripper, endpoints []string) *endpointRotator {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &endpointRotator{next: next, endpoints: endpoints}
+}
+
+func (r *endpointRotator) RoundTrip(req *http.Request) (*http.Response, error) {
+	var lastErr error
+	for i := 0; i < len(r.endpoints); i++ {
+		cloned := req.Clone(req.Context())
+		cloned.URL.Host = r.current()
+		cloned.Host = cloned.URL.Host
+
+		resp, err := r.next.RoundTrip(cloned)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		r.advance()
+	}
+	return nil, lastErr
+}
+
+func (r *endpointRotator) current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endpoints[r.index%len(r.endpoints)]
+}
+
+func (r *endpointRotator) advance() {
+	r.mu.Lock()
+	r.index++
+	r.mu.Unlock()
 }
 
 // InitializeConsul creates a new Consul client given
 // a list of endpoints and optional tls config
 func InitializeConsul(endpoints []string, options ...interface{}) (Store, error) {
 	s := &Consul{}
-	s.sessions = make(map[string]*api.Session)
+	s.sessions = make(map[string]*sessionLock)
 	s.watches = make(map[string]*Watch)
 
 	// Create Consul client
 	config := api.DefaultConfig()
 	s.config = config
-	config.HttpClient = http.DefaultClient
-	config.Address = endpoints[0]
+	// Each Consul client gets its own *http.Client rather than the
+	// process-wide http.DefaultClient: SetConsulOptions installs an
+	// endpoint-failover RoundTripper on config.HttpClient.Transport,
+	// and sharing http.DefaultClient would let one client's transport
+	// stomp another's (or any unrelated code in the process using
+	// http.DefaultClient).
+	config.HttpClient = &http.Client{}
 	config.Scheme = "http"
 
+	// Route endpoints through the same failover mechanism as
+	// ConsulOptions.Endpoints, rather than silently dropping all but
+	// endpoints[0]. A ConsulOptions passed in options still takes
+	// precedence if the caller explicitly sets its own Endpoints.
+	s.SetConsulOptions(ConsulOptions{Endpoints: endpoints})
+
 	// Sets all the options
 	s.SetOptions(options...)
 
@@ -71,6 +287,9 @@ func (s *Consul) SetOptions(options ...interface{}) {
 		case time.Duration:
 			s.SetTimeout(opt)
 
+		case ConsulOptions:
+			s.SetConsulOptions(opt)
+
 		default:
 			// TODO give more meaningful information to print
 			log.Info("store: option unsupported for consul")
@@ -94,10 +313,29 @@ func (s *Consul) SetTimeout(time time.Duration) {
 	s.config.WaitTime = time
 }
 
+// SetConsulOptions records the per-client defaults for ACL token,
+// datacenter, namespace and consistency, and installs an endpoint
+// failover RoundTripper when more than one endpoint is given
+func (s *Consul) SetConsulOptions(options ConsulOptions) {
+	s.options = options
+	if len(options.Endpoints) == 0 {
+		return
+	}
+	s.config.Address = options.Endpoints[0]
+	if len(options.Endpoints) > 1 {
+		s.config.HttpClient.Transport = newEndpointRotator(s.config.HttpClient.Transport, options.Endpoints)
+	}
+}
+
 // Get the value at "key", returns the last modified index
 // to use in conjunction to CAS calls
-func (s *Consul) Get(key string) (value []byte, lastIndex uint64, err error) {
-	pair, meta, err := s.client.KV().Get(partialFormat(key), nil)
+func (s *Consul) Get(key string, opts ...CallOption) (value []byte, lastIndex uint64, err error) {
+	return s.GetCtx(context.Background(), key, opts...)
+}
+
+// GetCtx is the context-aware equivalent of Get
+func (s *Consul) GetCtx(ctx context.Context, key string, opts ...CallOption) (value []byte, lastIndex uint64, err error) {
+	pair, meta, err := s.client.KV().Get(partialFormat(key), s.callConfig(opts...).queryOptions(ctx, nil))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -108,24 +346,39 @@ func (s *Consul) Get(key string) (value []byte, lastIndex uint64, err error) {
 }
 
 // Put a value at "key"
-func (s *Consul) Put(key string, value []byte) error {
+func (s *Consul) Put(key string, value []byte, opts ...CallOption) error {
+	return s.PutCtx(context.Background(), key, value, opts...)
+}
+
+// PutCtx is the context-aware equivalent of Put
+func (s *Consul) PutCtx(ctx context.Context, key string, value []byte, opts ...CallOption) error {
 	p := &api.KVPair{Key: partialFormat(key), Value: value}
 	if s.client == nil {
 		log.Error("Error initializing client")
 	}
-	_, err := s.client.KV().Put(p, nil)
+	_, err := s.client.KV().Put(p, s.callConfig(opts...).writeOptions(ctx))
 	return err
 }
 
 // Delete a value at "key"
-func (s *Consul) Delete(key string) error {
-	_, err := s.client.KV().Delete(partialFormat(key), nil)
+func (s *Consul) Delete(key string, opts ...CallOption) error {
+	return s.DeleteCtx(context.Background(), key, opts...)
+}
+
+// DeleteCtx is the context-aware equivalent of Delete
+func (s *Consul) DeleteCtx(ctx context.Context, key string, opts ...CallOption) error {
+	_, err := s.client.KV().Delete(partialFormat(key), s.callConfig(opts...).writeOptions(ctx))
 	return err
 }
 
 // Exists checks that the key exists inside the store
-func (s *Consul) Exists(key string) (bool, error) {
-	_, _, err := s.Get(key)
+func (s *Consul) Exists(key string, opts ...CallOption) (bool, error) {
+	return s.ExistsCtx(context.Background(), key, opts...)
+}
+
+// ExistsCtx is the context-aware equivalent of Exists
+func (s *Consul) ExistsCtx(ctx context.Context, key string, opts ...CallOption) (bool, error) {
+	_, _, err := s.GetCtx(ctx, key, opts...)
 	if err != nil && err == ErrKeyNotFound {
 		return false, err
 	}
@@ -133,8 +386,13 @@ func (s *Consul) Exists(key string) (bool, error) {
 }
 
 // GetRange gets a range of values at "directory"
-func (s *Consul) GetRange(prefix string) (values [][]byte, err error) {
-	pairs, _, err := s.client.KV().List(partialFormat(prefix), nil)
+func (s *Consul) GetRange(prefix string, opts ...CallOption) (values [][]byte, err error) {
+	return s.GetRangeCtx(context.Background(), prefix, opts...)
+}
+
+// GetRangeCtx is the context-aware equivalent of GetRange
+func (s *Consul) GetRangeCtx(ctx context.Context, prefix string, opts ...CallOption) (values [][]byte, err error) {
+	pairs, _, err := s.client.KV().List(partialFormat(prefix), s.callConfig(opts...).queryOptions(ctx, nil))
 	if err != nil {
 		return nil, err
 	}
@@ -148,88 +406,381 @@ func (s *Consul) GetRange(prefix string) (values [][]byte, err error) {
 }
 
 // DeleteRange deletes a range of values at "directory"
-func (s *Consul) DeleteRange(prefix string) error {
-	_, err := s.client.KV().DeleteTree(partialFormat(prefix), nil)
+func (s *Consul) DeleteRange(prefix string, opts ...CallOption) error {
+	return s.DeleteRangeCtx(context.Background(), prefix, opts...)
+}
+
+// DeleteRangeCtx is the context-aware equivalent of DeleteRange
+func (s *Consul) DeleteRangeCtx(ctx context.Context, prefix string, opts ...CallOption) error {
+	_, err := s.client.KV().DeleteTree(partialFormat(prefix), s.callConfig(opts...).writeOptions(ctx))
 	return err
 }
 
-// Watch a single key for modifications
-func (s *Consul) Watch(key string, heartbeat time.Duration, callback WatchCallback) error {
+// EventType classifies a change reported by a watch
+type EventType int
+
+const (
+	// PUT means the key was created or updated
+	PUT EventType = iota
+	// DELETE means the key was removed
+	DELETE
+	// CONNECTIONDOWN means the watch lost contact with the cluster
+	CONNECTIONDOWN
+	// UNKNOWN is used when an event cannot be classified
+	UNKNOWN
+)
+
+// Event describes a single change observed by a watch
+type Event struct {
+	Type        EventType
+	Key         string
+	Value       []byte
+	Session     string
+	Lease       time.Duration
+	ModifyIndex uint64
+}
+
+// WatchEventCallback is called with a typed Event for every change a
+// watch observes, including connection loss
+type WatchEventCallback func(Event)
+
+// isConnectionError reports whether err indicates Consul itself is
+// unreachable, as opposed to a transient request-level failure
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "connection refused") ||
+		strings.Contains(err.Error(), "EOF") ||
+		strings.Contains(err.Error(), "no such host")
+}
+
+// diffEvent classifies the change between two observations of a key
+// into a PUT or DELETE Event. It never talks to Consul - a PUT made
+// under a session has its Lease filled in separately by sessionLease,
+// since that requires a lookup - so it can be tested in isolation.
+func diffEvent(key string, previous, current *api.KVPair) Event {
+	if current == nil {
+		if previous == nil {
+			return Event{Type: UNKNOWN, Key: key}
+		}
+		return Event{Type: DELETE, Key: key, ModifyIndex: previous.ModifyIndex}
+	}
+	return Event{
+		Type:        PUT,
+		Key:         current.Key,
+		Value:       current.Value,
+		Session:     current.Session,
+		ModifyIndex: current.ModifyIndex,
+	}
+}
+
+// sessionLease resolves a lock session's configured TTL so it can
+// populate Event.Lease on a PUT event written under that session. A
+// lookup failure (e.g. the session has already expired) just leaves
+// Lease at its zero value rather than failing the whole watch.
+func (s *Consul) sessionLease(id string) time.Duration {
+	entry, _, err := s.client.Session().Info(id, nil)
+	if err != nil || entry == nil {
+		return 0
+	}
+	ttl, err := time.ParseDuration(entry.TTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// withLease fills in event.Lease for a PUT event written under a
+// session
+func (s *Consul) withLease(event Event) Event {
+	if event.Type == PUT && event.Session != "" {
+		event.Lease = s.sessionLease(event.Session)
+	}
+	return event
+}
+
+// Watch a single key for modifications; the legacy callback drops
+// event metadata, see WatchEvent to receive typed Events
+func (s *Consul) Watch(key string, heartbeat time.Duration, callback WatchCallback, opts ...CallOption) error {
+	return s.WatchCtx(context.Background(), key, heartbeat, callback, opts...)
+}
+
+// WatchCtx is the context-aware equivalent of Watch
+func (s *Consul) WatchCtx(ctx context.Context, key string, heartbeat time.Duration, callback WatchCallback, opts ...CallOption) error {
+	return s.WatchEventCtx(ctx, key, heartbeat, func(event Event) {
+		if event.Type != PUT {
+			return
+		}
+		callback([][]byte{event.Value})
+	}, opts...)
+}
+
+// WatchEvent is the typed-event equivalent of Watch
+func (s *Consul) WatchEvent(key string, heartbeat time.Duration, callback WatchEventCallback, opts ...CallOption) error {
+	return s.WatchEventCtx(context.Background(), key, heartbeat, callback, opts...)
+}
+
+// WatchEventCtx watches a single key, invoking callback with a typed
+// Event for every PUT, DELETE or CONNECTIONDOWN observed
+func (s *Consul) WatchEventCtx(ctx context.Context, key string, heartbeat time.Duration, callback WatchEventCallback, opts ...CallOption) error {
 	key = partialFormat(key)
-	interval := heartbeat
-	eventChan := s.waitForChange(key)
-	s.watches[key] = &Watch{Interval: interval, EventChan: eventChan}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for _ = range eventChan {
+	s.mu.Lock()
+	s.watches[key] = &Watch{cancel: cancel}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watches, key)
+		s.mu.Unlock()
+	}()
+
+	eventChan := s.waitForChange(ctx, key, s.callConfig(opts...))
+	s.mu.Lock()
+	s.watches[key].Interval = heartbeat
+	s.watches[key].EventChan = eventChan
+	s.mu.Unlock()
+
+	for event := range eventChan {
 		log.WithField("name", "consul").Debug("Key watch triggered")
-		entry, _, err := s.Get(key)
-		if err != nil {
-			log.Error("Cannot refresh the key: ", key, ", cancelling watch")
-			s.watches[key] = nil
-			return err
+		callback(event)
+		if event.Type == CONNECTIONDOWN {
+			return nil
 		}
-
-		value := [][]byte{[]byte(entry)}
-		callback(value)
 	}
 
 	return nil
 }
 
-// CancelWatch cancels a watch, sends a signal to the appropriate
-// stop channel
+// CancelWatch cancels a watch, stopping its long-poll goroutine and
+// removing its entry from the watch table
 func (s *Consul) CancelWatch(key string) error {
 	key = partialFormat(key)
-	if _, ok := s.watches[key]; !ok {
+	s.mu.Lock()
+	watch, ok := s.watches[key]
+	if ok {
+		delete(s.watches, key)
+	}
+	s.mu.Unlock()
+	if !ok {
 		log.Error("Chan does not exist for key: ", key)
 		return ErrWatchDoesNotExist
 	}
-	s.watches[key] = nil
+	watch.cancel()
 	return nil
 }
 
-// Internal function to check if a key has changed
-func (s *Consul) waitForChange(key string) <-chan uint64 {
-	ch := make(chan uint64)
+// Internal function to check if a key has changed, exiting as soon
+// as ctx is cancelled rather than waiting for Consul to reply
+func (s *Consul) waitForChange(ctx context.Context, key string, cfg *callConfig) <-chan Event {
+	ch := make(chan Event)
 	go func() {
+		defer close(ch)
+		var previous *api.KVPair
+		first := true
 		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			s.mu.Lock()
 			watch, ok := s.watches[key]
+			s.mu.Unlock()
 			if !ok {
 				log.Error("Cannot access last index for key: ", key, " closing channel")
-				break
+				return
 			}
-			option := &api.QueryOptions{
+			option := cfg.queryOptions(ctx, &api.QueryOptions{
 				WaitIndex: watch.LastIndex,
-				WaitTime:  watch.Interval}
-			_, meta, err := s.client.KV().Get(key, option)
+				WaitTime:  watch.Interval,
+			})
+			pair, meta, err := s.client.KV().Get(key, option)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if isConnectionError(err) {
+					select {
+					case ch <- Event{Type: CONNECTIONDOWN, Key: key}:
+					case <-ctx.Done():
+					}
+					return
+				}
 				log.WithField("name", "consul").Errorf("Discovery error: %v", err)
-				break
+				return
 			}
 			watch.LastIndex = meta.LastIndex
-			ch <- watch.LastIndex
+
+			// The very first Get is a non-blocking read of the key's
+			// current state (WaitIndex starts at 0), not an actual
+			// change. Use it only to establish a baseline so callers
+			// don't see a synthetic PUT/DELETE for a key that never
+			// changed, which would otherwise busy-loop anyone polling
+			// "has this key changed yet".
+			if first {
+				first = false
+				previous = pair
+				continue
+			}
+
+			event := s.withLease(diffEvent(key, previous, pair))
+			previous = pair
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(ch)
 	}()
 	return ch
 }
 
-// WatchRange triggers a watch on a range of values at "directory"
-func (s *Consul) WatchRange(prefix string, filter string, heartbeat time.Duration, callback WatchCallback) error {
-	prefix = partialFormat(prefix)
-	interval := heartbeat
-	eventChan := s.waitForChange(prefix)
-	s.watches[prefix] = &Watch{Interval: interval, EventChan: eventChan}
+// waitForRangeChange blocks until the children of prefix change,
+// emitting one Event per created, updated or deleted key, diffed by
+// key and ModifyIndex against the previous List result
+func (s *Consul) waitForRangeChange(ctx context.Context, prefix string, cfg *callConfig) <-chan []Event {
+	ch := make(chan []Event)
+	go func() {
+		defer close(ch)
+		previous := map[string]*api.KVPair{}
+		first := true
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
 
-	for _ = range eventChan {
-		log.WithField("name", "consul").Debug("Key watch triggered")
-		values, err := s.GetRange(prefix)
-		if err != nil {
-			log.Error("Cannot refresh keys with prefix: ", prefix, ", cancelling watch")
-			s.watches[prefix] = nil
-			return err
+			s.mu.Lock()
+			watch, ok := s.watches[prefix]
+			s.mu.Unlock()
+			if !ok {
+				log.Error("Cannot access last index for prefix: ", prefix, " closing channel")
+				return
+			}
+			option := cfg.queryOptions(ctx, &api.QueryOptions{
+				WaitIndex: watch.LastIndex,
+				WaitTime:  watch.Interval,
+			})
+			pairs, meta, err := s.client.KV().List(prefix, option)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if isConnectionError(err) {
+					select {
+					case ch <- []Event{{Type: CONNECTIONDOWN, Key: prefix}}:
+					case <-ctx.Done():
+					}
+					return
+				}
+				log.WithField("name", "consul").Errorf("Discovery error: %v", err)
+				return
+			}
+			watch.LastIndex = meta.LastIndex
+
+			current := make(map[string]*api.KVPair, len(pairs))
+			for _, pair := range pairs {
+				current[pair.Key] = pair
+			}
+
+			// As in waitForChange, the first List is a non-blocking
+			// snapshot of the prefix's current children, not a real
+			// change. Use it only to seed "previous" so it doesn't
+			// get reported as every child being newly PUT.
+			if first {
+				first = false
+				previous = current
+				continue
+			}
+
+			var events []Event
+			for _, pair := range pairs {
+				if old, ok := previous[pair.Key]; !ok || old.ModifyIndex != pair.ModifyIndex {
+					events = append(events, s.withLease(diffEvent(pair.Key, old, pair)))
+				}
+			}
+			for key, old := range previous {
+				if _, ok := current[key]; !ok {
+					events = append(events, diffEvent(key, old, nil))
+				}
+			}
+			previous = current
+
+			if len(events) == 0 {
+				continue
+			}
+			select {
+			case ch <- events:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// WatchRange triggers a watch on a range of values at "directory";
+// the legacy callback drops event metadata, see WatchRangeEvent to
+// receive typed Events
+func (s *Consul) WatchRange(prefix string, filter string, heartbeat time.Duration, callback WatchCallback, opts ...CallOption) error {
+	return s.WatchRangeCtx(context.Background(), prefix, filter, heartbeat, callback, opts...)
+}
+
+// WatchRangeCtx is the context-aware equivalent of WatchRange
+func (s *Consul) WatchRangeCtx(ctx context.Context, prefix string, filter string, heartbeat time.Duration, callback WatchCallback, opts ...CallOption) error {
+	return s.WatchRangeEventCtx(ctx, prefix, heartbeat, func(events []Event) {
+		values := make([][]byte, 0, len(events))
+		for _, event := range events {
+			if event.Type != PUT {
+				continue
+			}
+			values = append(values, event.Value)
 		}
 		callback(values)
+	}, opts...)
+}
+
+// WatchRangeEvent is the typed-event equivalent of WatchRange
+func (s *Consul) WatchRangeEvent(prefix string, heartbeat time.Duration, callback func([]Event), opts ...CallOption) error {
+	return s.WatchRangeEventCtx(context.Background(), prefix, heartbeat, callback, opts...)
+}
+
+// WatchRangeEventCtx watches a range of keys, invoking callback with
+// the batch of Events observed on every change
+func (s *Consul) WatchRangeEventCtx(ctx context.Context, prefix string, heartbeat time.Duration, callback func([]Event), opts ...CallOption) error {
+	prefix = partialFormat(prefix)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	s.watches[prefix] = &Watch{cancel: cancel}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watches, prefix)
+		s.mu.Unlock()
+	}()
+
+	eventChan := s.waitForRangeChange(ctx, prefix, s.callConfig(opts...))
+	s.mu.Lock()
+	s.watches[prefix].Interval = heartbeat
+	s.watches[prefix].EventChan = eventChan
+	s.mu.Unlock()
+
+	for events := range eventChan {
+		log.WithField("name", "consul").Debug("Range watch triggered")
+		callback(events)
+		for _, event := range events {
+			if event.Type == CONNECTIONDOWN {
+				return nil
+			}
+		}
 	}
 
 	return nil
@@ -241,45 +792,129 @@ func (s *Consul) CancelWatchRange(prefix string) error {
 	return s.CancelWatch(prefix)
 }
 
-// Acquire the lock for "key"/"directory"
-func (s *Consul) Acquire(key string, value []byte) (string, error) {
+// Acquire the lock for "key"/"directory", backed by a TTL'd Consul
+// session so the lock is automatically released if this client dies
+func (s *Consul) Acquire(key string, value []byte, options *LockOptions, opts ...CallOption) (string, error) {
+	return s.AcquireCtx(context.Background(), key, value, options, opts...)
+}
+
+// AcquireCtx is the context-aware equivalent of Acquire
+func (s *Consul) AcquireCtx(ctx context.Context, key string, value []byte, options *LockOptions, opts ...CallOption) (string, error) {
 	key = partialFormat(key)
+	cfg := s.callConfig(opts...)
+
+	ttl := defaultLockTTL
+	renewPeriod := defaultRenewPeriod
+	var lockDelay time.Duration
+	if options != nil {
+		if options.TTL != 0 {
+			ttl = options.TTL
+			renewPeriod = ttl / 3
+		}
+		if options.RenewPeriod != 0 {
+			renewPeriod = options.RenewPeriod
+		}
+		lockDelay = options.LockDelay
+	}
+
 	session := s.client.Session()
-	id, _, err := session.CreateNoChecks(nil, nil)
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorRelease,
+		TTL:       ttl.String(),
+		LockDelay: lockDelay,
+	}
+	id, _, err := session.Create(entry, cfg.writeOptions(ctx))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %v", ErrSessionRenew, err)
 	}
 
-	// Add session to map
-	s.sessions[id] = session
+	lock := &sessionLock{session: session, doneCh: make(chan struct{})}
+	s.mu.Lock()
+	s.sessions[id] = lock
+	s.mu.Unlock()
+	go s.renewSession(session, id, renewPeriod, lock.doneCh)
 
 	p := &api.KVPair{Key: key, Value: value, Session: id}
-	if work, _, err := s.client.KV().Acquire(p, nil); err != nil {
+	work, _, err := s.client.KV().Acquire(p, cfg.writeOptions(ctx))
+	if err != nil {
+		s.destroySession(id, lock)
 		return "", err
-	} else if !work {
+	}
+	if !work {
+		// Lock already held by someone else: this session was never
+		// going to be used, so tear it down rather than leaving it
+		// (and its renewal goroutine) running forever.
+		s.destroySession(id, lock)
 		return "", ErrCannotLock
 	}
 
 	return id, nil
 }
 
+// renewSession periodically renews a lock's session until doneCh is
+// closed, giving up after RenewSessionRetryMax consecutive failures
+// so a partitioned client doesn't renew forever
+func (s *Consul) renewSession(session *api.Session, id string, period time.Duration, doneCh chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+			if _, _, err := session.Renew(id, nil); err != nil {
+				failures++
+				log.WithField("name", "consul").Errorf("Failed to renew session %s: %v", id, err)
+				if failures >= RenewSessionRetryMax {
+					log.WithField("name", "consul").Errorf("Giving up renewing session %s after %d attempts", id, failures)
+					return
+				}
+				continue
+			}
+			failures = 0
+		case <-doneCh:
+			return
+		}
+	}
+}
+
 // Release the lock for "key"/"directory"
 func (s *Consul) Release(id string) error {
-	if _, ok := s.sessions[id]; !ok {
+	s.mu.Lock()
+	lock, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
 		log.Error("Lock session does not exist")
 		return ErrSessionUndefined
 	}
-	session := s.sessions[id]
-	session.Destroy(id, nil)
-	s.sessions[id] = nil
-	return nil
+	return s.destroySession(id, lock)
+}
+
+// destroySession stops a session's renewal goroutine and destroys the
+// session itself, retrying transient Destroy failures up to
+// MaxSessionDestroyAttempts times. Used both by Release and to clean
+// up a session whose Acquire never succeeded.
+func (s *Consul) destroySession(id string, lock *sessionLock) error {
+	close(lock.doneCh)
+
+	var err error
+	for attempt := 1; attempt <= MaxSessionDestroyAttempts; attempt++ {
+		if _, err = lock.session.Destroy(id, nil); err == nil {
+			break
+		}
+		log.WithField("name", "consul").Errorf("Failed to destroy session %s (attempt %d/%d): %v", id, attempt, MaxSessionDestroyAttempts, err)
+	}
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	return err
 }
 
 // AtomicPut put a value at "key" if the key has not been
 // modified in the meantime, throws an error if this is the case
-func (s *Consul) AtomicPut(key string, _ []byte, newValue []byte, index uint64) (bool, error) {
+func (s *Consul) AtomicPut(key string, _ []byte, newValue []byte, index uint64, opts ...CallOption) (bool, error) {
 	p := &api.KVPair{Key: partialFormat(key), Value: newValue, ModifyIndex: index}
-	if work, _, err := s.client.KV().CAS(p, nil); err != nil {
+	if work, _, err := s.client.KV().CAS(p, s.callConfig(opts...).writeOptions(context.Background())); err != nil {
 		return false, err
 	} else if !work {
 		return false, ErrKeyModified
@@ -289,12 +924,303 @@ func (s *Consul) AtomicPut(key string, _ []byte, newValue []byte, index uint64)
 
 // AtomicDelete deletes a value at "key" if the key has not
 // been modified in the meantime, throws an error if this is the case
-func (s *Consul) AtomicDelete(key string, oldValue []byte, index uint64) (bool, error) {
+func (s *Consul) AtomicDelete(key string, oldValue []byte, index uint64, opts ...CallOption) (bool, error) {
 	p := &api.KVPair{Key: partialFormat(key), ModifyIndex: index}
-	if work, _, err := s.client.KV().DeleteCAS(p, nil); err != nil {
+	if work, _, err := s.client.KV().DeleteCAS(p, s.callConfig(opts...).writeOptions(context.Background())); err != nil {
 		return false, err
 	} else if !work {
 		return false, ErrKeyModified
 	}
 	return true, nil
 }
+
+// Tx batches key/value operations so they can be committed to Consul
+// atomically via the Txn API, e.g. to update an index and the blobs
+// it references in one round-trip
+type Tx struct {
+	client *api.Client
+	cfg    *callConfig
+	ops    api.KVTxnOps
+}
+
+// NewTx returns a new transaction builder bound to this client. Any
+// CallOptions given (token, datacenter, namespace, consistency) apply
+// to the whole transaction when it is committed.
+func (s *Consul) NewTx(opts ...CallOption) *Tx {
+	return &Tx{client: s.client, cfg: s.callConfig(opts...)}
+}
+
+// Put stages an unconditional set of key to value
+func (tx *Tx) Put(key string, value []byte) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVSet, Key: partialFormat(key), Value: value})
+	return tx
+}
+
+// CAS stages a set of key to value that only applies if the key's
+// ModifyIndex still matches index
+func (tx *Tx) CAS(key string, value []byte, index uint64) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVCAS, Key: partialFormat(key), Value: value, Index: index})
+	return tx
+}
+
+// Delete stages an unconditional delete of key
+func (tx *Tx) Delete(key string) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVDelete, Key: partialFormat(key)})
+	return tx
+}
+
+// CASDelete stages a delete of key that only applies if its
+// ModifyIndex still matches index
+func (tx *Tx) CASDelete(key string, index uint64) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: partialFormat(key), Index: index})
+	return tx
+}
+
+// CheckIndex stages a read-only check that key's ModifyIndex still
+// matches index, failing the whole transaction otherwise
+func (tx *Tx) CheckIndex(key string, index uint64) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVCheckIndex, Key: partialFormat(key), Index: index})
+	return tx
+}
+
+// CheckSession stages a read-only check that key is still held by
+// session, failing the whole transaction otherwise
+func (tx *Tx) CheckSession(key, session string) *Tx {
+	tx.ops = append(tx.ops, &api.KVTxnOp{Verb: api.KVCheckSession, Key: partialFormat(key), Session: session})
+	return tx
+}
+
+// Commit submits all staged operations to Consul atomically. It
+// returns false alongside a composite error describing every failed
+// check when the transaction is rejected
+func (tx *Tx) Commit(ctx context.Context) (bool, *api.KVTxnResponse, error) {
+	ok, response, _, err := tx.client.KV().Txn(tx.ops, tx.cfg.queryOptions(ctx, nil))
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		return false, response, newTxError(response.Errors)
+	}
+	return true, response, nil
+}
+
+// newTxError builds a single error summarizing every failed check
+// reported for a rejected transaction
+func newTxError(errs api.TxnErrors) error {
+	if len(errs) == 0 {
+		return ErrTxFailed
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, fmt.Sprintf("op %d: %s", e.OpIndex, e.What))
+	}
+	return fmt.Errorf("%w: %s", ErrTxFailed, strings.Join(msgs, "; "))
+}
+
+// ElectOptions configures a leader election
+type ElectOptions struct {
+	LockOptions // session TTL/RenewPeriod/LockDelay for the underlying lock
+
+	// HandoffTimeout bounds how long Resign waits for a new leader to
+	// appear before destroying its session, defaults to the lock TTL
+	HandoffTimeout time.Duration
+}
+
+// Election represents a single participant's handle on a leader
+// election for a key
+type Election interface {
+	// LeaderCh reports leadership transitions: true when this
+	// participant becomes leader, false when it steps down
+	LeaderCh() <-chan bool
+
+	// Leader returns the value currently held at the election key,
+	// i.e. the identity of the current leader
+	Leader(ctx context.Context) (value []byte, err error)
+
+	// Resign gives up leadership, handing off to a waiting
+	// candidate before destroying its session
+	Resign(ctx context.Context) error
+}
+
+// consulElection is the Consul-backed Election implementation
+type consulElection struct {
+	store *Consul
+	key   string
+	value []byte
+	opts  ElectOptions
+
+	leaderCh   chan bool
+	cancel     context.CancelFunc
+	resignOnce sync.Once
+
+	mu        sync.Mutex
+	sessionID string
+	isLeader  bool
+}
+
+// Elect participates in a leader election for key, returning an
+// Election handle while a campaign goroutine runs in the background.
+// Leadership is backed by a TTL'd session, so a dead participant's
+// hold on key is released automatically
+func (s *Consul) Elect(ctx context.Context, key string, value []byte, opts *ElectOptions) (Election, error) {
+	if opts == nil {
+		opts = &ElectOptions{}
+	}
+	campaignCtx, cancel := context.WithCancel(ctx)
+	e := &consulElection{
+		store:    s,
+		key:      partialFormat(key),
+		value:    value,
+		opts:     *opts,
+		leaderCh: make(chan bool, 1),
+		cancel:   cancel,
+	}
+	go e.campaign(campaignCtx)
+	return e, nil
+}
+
+// campaign repeatedly tries to acquire the election key, holding
+// leadership until the session is lost and retrying once another
+// participant's hold on the key goes away. ctx is cancelled by
+// Resign, which unblocks campaign immediately even while it is
+// parked inside waitForKeyChange waiting on someone else's hold on
+// the key to clear
+func (e *consulElection) campaign(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		id, err := e.store.AcquireCtx(ctx, e.key, e.value, &e.opts.LockOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			e.waitForKeyChange(ctx)
+			continue
+		}
+
+		e.mu.Lock()
+		e.sessionID = id
+		e.mu.Unlock()
+		e.setLeader(true)
+
+		e.waitForKeyChange(ctx)
+		e.setLeader(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// waitForKeyChange blocks until the election key's next PUT, DELETE
+// or CONNECTIONDOWN event, or until ctx is done
+func (e *consulElection) waitForKeyChange(ctx context.Context) {
+	_ = e.store.WatchEventCtx(ctx, e.key, 0, func(event Event) {
+		e.store.CancelWatch(e.key)
+	})
+}
+
+// setLeader reports a leadership transition on LeaderCh, but only
+// when it's actually an edge change
+func (e *consulElection) setLeader(leader bool) {
+	e.mu.Lock()
+	changed := leader != e.isLeader
+	e.isLeader = leader
+	e.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	select {
+	case e.leaderCh <- leader:
+	default:
+		select {
+		case <-e.leaderCh:
+		default:
+		}
+		e.leaderCh <- leader
+	}
+}
+
+// LeaderCh reports leadership transitions for this participant
+func (e *consulElection) LeaderCh() <-chan bool {
+	return e.leaderCh
+}
+
+// Leader returns the value currently held at the election key
+func (e *consulElection) Leader(ctx context.Context) ([]byte, error) {
+	value, _, err := e.store.GetCtx(ctx, e.key)
+	return value, err
+}
+
+// Resign performs a graceful handoff: it releases the key (without
+// deleting it), waits up to opts.HandoffTimeout for a new holder to
+// appear, then destroys its session. This mirrors the three-attempt
+// leadership-transfer retry loop so schedulers don't see a leader gap
+// during a rolling restart. Resign is safe to call more than once and
+// from more than one goroutine: campaign's context is only ever
+// cancelled the first time
+func (e *consulElection) Resign(ctx context.Context) error {
+	e.resignOnce.Do(e.cancel)
+
+	e.mu.Lock()
+	id := e.sessionID
+	e.mu.Unlock()
+	if id == "" {
+		return nil
+	}
+
+	p := &api.KVPair{Key: e.key, Value: e.value, Session: id}
+	if _, err := e.store.client.KV().Release(p, nil); err != nil {
+		log.WithField("name", "consul").Errorf("Failed to release key %s on resign: %v", e.key, err)
+	}
+
+	handoff := e.opts.HandoffTimeout
+	if handoff == 0 {
+		handoff = defaultLockTTL
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := e.awaitNewHolder(ctx, id, handoff); err == nil {
+			break
+		} else {
+			log.WithField("name", "consul").Errorf("Resign handoff attempt %d/3 for key %s: %v", attempt, e.key, err)
+		}
+	}
+
+	return e.store.Release(id)
+}
+
+// awaitNewHolder blocks, bounded by timeout, until a different
+// session acquires the election key
+func (e *consulElection) awaitNewHolder(ctx context.Context, previousSessionID string, timeout time.Duration) error {
+	deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pair, meta, err := e.store.client.KV().Get(e.key, nil)
+	if err != nil {
+		return err
+	}
+	var lastIndex uint64
+	if meta != nil {
+		lastIndex = meta.LastIndex
+	}
+
+	for {
+		if pair != nil && pair.Session != "" && pair.Session != previousSessionID {
+			return nil
+		}
+		if deadlineCtx.Err() != nil {
+			return deadlineCtx.Err()
+		}
+		opts := (&callConfig{}).queryOptions(deadlineCtx, &api.QueryOptions{WaitIndex: lastIndex})
+		pair, meta, err = e.store.client.KV().Get(e.key, opts)
+		if err != nil {
+			return err
+		}
+		lastIndex = meta.LastIndex
+	}
+}
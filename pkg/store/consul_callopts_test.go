@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestCallConfigQueryOptions(t *testing.T) {
+	c := &callConfig{token: "tok", datacenter: "dc1", namespace: "ns1", consistency: ConsistencyStale}
+	opts := c.queryOptions(context.Background(), nil)
+	if opts.Token != "tok" || opts.Datacenter != "dc1" || opts.Namespace != "ns1" || !opts.AllowStale {
+		t.Errorf("queryOptions = %+v, want token/datacenter/namespace copied and AllowStale set", opts)
+	}
+}
+
+func TestCallConfigQueryOptionsConsistent(t *testing.T) {
+	c := &callConfig{consistency: ConsistencyConsistent}
+	opts := c.queryOptions(context.Background(), nil)
+	if !opts.RequireConsistent {
+		t.Errorf("RequireConsistent = false, want true for ConsistencyConsistent")
+	}
+}
+
+func TestCallConfigQueryOptionsDeadlineBecomesWaitTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	c := &callConfig{}
+	opts := c.queryOptions(ctx, nil)
+	if opts.WaitTime <= 0 || opts.WaitTime > 50*time.Millisecond {
+		t.Errorf("WaitTime = %v, want a positive duration bounded by the context deadline", opts.WaitTime)
+	}
+}
+
+func TestCallConfigQueryOptionsKeepsShorterExistingWaitTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	c := &callConfig{}
+	opts := c.queryOptions(ctx, &api.QueryOptions{WaitTime: 10 * time.Millisecond})
+	if opts.WaitTime != 10*time.Millisecond {
+		t.Errorf("WaitTime = %v, want the shorter base.WaitTime of 10ms to be kept", opts.WaitTime)
+	}
+}
+
+func TestCallConfigWriteOptions(t *testing.T) {
+	c := &callConfig{token: "tok", datacenter: "dc1", namespace: "ns1"}
+	opts := c.writeOptions(context.Background())
+	if opts.Token != "tok" || opts.Datacenter != "dc1" || opts.Namespace != "ns1" {
+		t.Errorf("writeOptions = %+v, want token/datacenter/namespace copied from callConfig", opts)
+	}
+}
+
+// stubRoundTripper records the host each request was sent to, failing
+// every request to a host in failHosts.
+type stubRoundTripper struct {
+	failHosts map[string]bool
+	gotHosts  []string
+}
+
+func (s *stubRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.gotHosts = append(s.gotHosts, req.URL.Host)
+	if s.failHosts[req.URL.Host] {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestEndpointRotatorAdvancesPastFailingEndpoints(t *testing.T) {
+	stub := &stubRoundTripper{failHosts: map[string]bool{"a:8500": true, "b:8500": true}}
+	r := newEndpointRotator(stub, []string{"a:8500", "b:8500", "c:8500"})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://a:8500/v1/kv/foo", nil)
+	resp, err := r.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d, want 200", resp.StatusCode)
+	}
+	if want := []string{"a:8500", "b:8500", "c:8500"}; !reflect.DeepEqual(stub.gotHosts, want) {
+		t.Errorf("gotHosts = %v, want %v", stub.gotHosts, want)
+	}
+
+	// The rotator should have remembered c:8500 as the endpoint to try
+	// first next time, rather than restarting from a:8500.
+	req2, _ := http.NewRequest(http.MethodGet, "http://a:8500/v1/kv/foo", nil)
+	stub.gotHosts = nil
+	if _, err := r.RoundTrip(req2); err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if len(stub.gotHosts) == 0 || stub.gotHosts[0] != "c:8500" {
+		t.Errorf("gotHosts[0] = %v, want c:8500 (rotator remembers its position)", stub.gotHosts)
+	}
+}
+
+func TestEndpointRotatorReturnsLastErrorWhenAllFail(t *testing.T) {
+	stub := &stubRoundTripper{failHosts: map[string]bool{"a:8500": true, "b:8500": true}}
+	r := newEndpointRotator(stub, []string{"a:8500", "b:8500"})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://a:8500/v1/kv/foo", nil)
+	if _, err := r.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip with all endpoints failing returned nil error")
+	}
+}
+
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestDiffEventUnknownWhenBothNil(t *testing.T) {
+	event := diffEvent("foo", nil, nil)
+	if event.Type != UNKNOWN || event.Key != "foo" {
+		t.Errorf("diffEvent(nil, nil) = %+v, want Type: UNKNOWN, Key: foo", event)
+	}
+}
+
+func TestDiffEventDelete(t *testing.T) {
+	previous := &api.KVPair{Key: "foo", ModifyIndex: 5}
+	event := diffEvent("foo", previous, nil)
+	if event.Type != DELETE || event.Key != "foo" || event.ModifyIndex != 5 {
+		t.Errorf("diffEvent(previous, nil) = %+v, want Type: DELETE, Key: foo, ModifyIndex: 5", event)
+	}
+}
+
+func TestDiffEventPut(t *testing.T) {
+	current := &api.KVPair{Key: "foo", Value: []byte("bar"), Session: "abc", ModifyIndex: 9}
+	event := diffEvent("foo", nil, current)
+	if event.Type != PUT || event.Key != "foo" || string(event.Value) != "bar" ||
+		event.Session != "abc" || event.ModifyIndex != 9 {
+		t.Errorf("diffEvent(nil, current) = %+v, want a PUT event matching current", event)
+	}
+	// diffEvent never resolves the session's TTL on its own; that's
+	// left to withLease so diffEvent stays pure and easy to test.
+	if event.Lease != 0 {
+		t.Errorf("Lease = %v, want 0 (unset by diffEvent)", event.Lease)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection refused", errString("dial tcp 127.0.0.1:8500: connect: connection refused"), true},
+		{"EOF", errString("unexpected EOF"), true},
+		{"no such host", errString("dial tcp: lookup consul: no such host"), true},
+		{"unrelated error", errString("invalid key"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isConnectionError(c.err); got != c.want {
+				t.Errorf("isConnectionError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// errString is a minimal error whose message is exactly the given
+// string, used to drive isConnectionError's substring matching.
+type errString string
+
+func (e errString) Error() string { return string(e) }
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestNewTxErrorNoErrors(t *testing.T) {
+	err := newTxError(nil)
+	if !errors.Is(err, ErrTxFailed) {
+		t.Errorf("newTxError(nil) = %v, want it to wrap ErrTxFailed", err)
+	}
+}
+
+func TestNewTxErrorSummarizesFailedOps(t *testing.T) {
+	errs := api.TxnErrors{
+		{OpIndex: 0, What: "key already exists"},
+		{OpIndex: 2, What: "CAS mismatch"},
+	}
+	err := newTxError(errs)
+	if !errors.Is(err, ErrTxFailed) {
+		t.Errorf("newTxError(errs) = %v, want it to wrap ErrTxFailed", err)
+	}
+	want := "op 0: key already exists; op 2: CAS mismatch"
+	if got := err.Error(); got != "Transaction failed, one or more operations could not be applied: "+want {
+		t.Errorf("newTxError(errs).Error() = %q, want it to contain %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package template
+
+import (
+	"text/template"
+	"text/template/parse"
+)
+
+// discoverRefs walks tmpl's parsed syntax tree (and that of any
+// associated templates, e.g. from {{ define }} blocks) looking for
+// key/ls/tree calls, so the manager knows which Store keys and
+// prefixes to watch. Operating on the parse tree rather than
+// regex-scanning the raw source means a reference is found no matter
+// how it's used in the template - piped (`{{ key "x" | trim }}`),
+// passed to another action (`{{ if key "x" }}`), inside a range/with,
+// etc. - as long as it appears somewhere in the tree; a key only
+// referenced from a branch that source never takes at render time is
+// still discovered and watched.
+func discoverRefs(tmpl *template.Template) (keys, prefixes []string) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkNode(t.Tree.Root, &keys, &prefixes)
+	}
+	return keys, prefixes
+}
+
+// walkNode recurses through a parsed template's nodes, collecting
+// key/ls/tree references from every pipeline it finds
+func walkNode(node parse.Node, keys, prefixes *[]string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkNode(child, keys, prefixes)
+		}
+	case *parse.ActionNode:
+		collectPipeRefs(n.Pipe, keys, prefixes)
+	case *parse.IfNode:
+		collectPipeRefs(n.Pipe, keys, prefixes)
+		walkNode(n.List, keys, prefixes)
+		walkNode(n.ElseList, keys, prefixes)
+	case *parse.RangeNode:
+		collectPipeRefs(n.Pipe, keys, prefixes)
+		walkNode(n.List, keys, prefixes)
+		walkNode(n.ElseList, keys, prefixes)
+	case *parse.WithNode:
+		collectPipeRefs(n.Pipe, keys, prefixes)
+		walkNode(n.List, keys, prefixes)
+		walkNode(n.ElseList, keys, prefixes)
+	case *parse.TemplateNode:
+		// The invoked template's own tree is walked separately via
+		// tmpl.Templates(); only its argument pipeline lives here.
+		collectPipeRefs(n.Pipe, keys, prefixes)
+	}
+}
+
+// collectPipeRefs scans every command in pipe for a key/ls/tree call
+// and records its string argument
+func collectPipeRefs(pipe *parse.PipeNode, keys, prefixes *[]string) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		if len(cmd.Args) < 2 {
+			continue
+		}
+		ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok {
+			continue
+		}
+		arg, ok := cmd.Args[1].(*parse.StringNode)
+		if !ok {
+			continue
+		}
+		switch ident.Ident {
+		case "key":
+			*keys = append(*keys, arg.Text)
+		case "ls", "tree":
+			*prefixes = append(*prefixes, arg.Text)
+		}
+	}
+}
+
+// funcMap builds the template funcmap backing {{ key "foo" }},
+// {{ ls "prefix/" }} and {{ tree "prefix/" }}. tree and ls share an
+// implementation because GetRange already flattens everything under
+// a prefix.
+func (m *Manager) funcMap() template.FuncMap {
+	ls := func(prefix string) ([]string, error) {
+		values, err := m.store.GetRange(prefix)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, len(values))
+		for i, value := range values {
+			out[i] = string(value)
+		}
+		return out, nil
+	}
+
+	return template.FuncMap{
+		"key": func(key string) (string, error) {
+			value, _, err := m.store.Get(key)
+			if err != nil {
+				return "", err
+			}
+			return string(value), nil
+		},
+		"ls":   ls,
+		"tree": ls,
+	}
+}
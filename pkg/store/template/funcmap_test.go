@@ -0,0 +1,101 @@
+package template
+
+import (
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+// stubFuncMap provides just-enough key/ls/tree implementations to
+// parse a template; discoverRefs only ever walks the parse tree, so
+// these are never called.
+func stubFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"key":  func(string) (string, error) { return "", nil },
+		"ls":   func(string) ([]string, error) { return nil, nil },
+		"tree": func(string) ([]string, error) { return nil, nil },
+	}
+}
+
+func parseForTest(t *testing.T, body, left, right string) *template.Template {
+	t.Helper()
+	tmpl, err := template.New("t").Delims(left, right).Funcs(stubFuncMap()).Parse(body)
+	if err != nil {
+		t.Fatalf("parse %q: %v", body, err)
+	}
+	return tmpl
+}
+
+func TestDiscoverRefs(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        string
+		left, right string
+		keys        []string
+		prefixes    []string
+	}{
+		{
+			name: "single key",
+			body: `upstream = {{ key "service/addr" }}`,
+			left: "{{", right: "}}",
+			keys: []string{"service/addr"},
+		},
+		{
+			name:     "key, ls and tree",
+			body:     `{{ key "a" }} {{ ls "b/" }} {{ tree "c/" }}`,
+			left:     "{{", right: "}}",
+			keys:     []string{"a"},
+			prefixes: []string{"b/", "c/"},
+		},
+		{
+			name: "trim markers",
+			body: `{{- key "y" -}}`,
+			left: "{{", right: "}}",
+			keys: []string{"y"},
+		},
+		{
+			name: "custom delimiters",
+			body: `<% key "x" %> <% ls "p/" %>`,
+			left: "<%", right: "%>",
+			keys:     []string{"x"},
+			prefixes: []string{"p/"},
+		},
+		{
+			name: "no refs",
+			body: "static content, no funcs here",
+			left: "{{", right: "}}",
+		},
+		{
+			name: "piped into another function",
+			body: `{{ key "x" | printf "%s" }}`,
+			left: "{{", right: "}}",
+			keys: []string{"x"},
+		},
+		{
+			name: "key used as an if condition, both branches discovered",
+			body: `{{ if key "a" }}{{ key "b" }}{{ else }}{{ key "c" }}{{ end }}`,
+			left: "{{", right: "}}",
+			keys: []string{"a", "b", "c"},
+		},
+		{
+			name:     "prefix driving a range, key used inside the loop body",
+			body:     `{{ range ls "p/" }}{{ key "x" }}{{ end }}`,
+			left:     "{{", right: "}}",
+			keys:     []string{"x"},
+			prefixes: []string{"p/"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tmpl := parseForTest(t, c.body, c.left, c.right)
+			keys, prefixes := discoverRefs(tmpl)
+			if !reflect.DeepEqual(keys, c.keys) {
+				t.Errorf("keys = %v, want %v", keys, c.keys)
+			}
+			if !reflect.DeepEqual(prefixes, c.prefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, c.prefixes)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+// Package template renders files from Go templates whose data comes
+// from Store keys, watching those keys and re-rendering whenever they
+// change. It plays the same role as consul-template, but against any
+// store.Store backend rather than Consul specifically.
+package template
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/swarm/pkg/store"
+)
+
+const (
+	// defaultMinDelay is the quiescence window's lower bound: a
+	// render waits at least this long after the last observed change
+	defaultMinDelay = 150 * time.Millisecond
+
+	// defaultMaxDelay is the quiescence window's upper bound: a burst
+	// of changes is never allowed to delay a render longer than this
+	defaultMaxDelay = 5 * time.Second
+
+	// defaultPerms is the file mode used for rendered output when
+	// TemplateConfig.Perms is unset
+	defaultPerms = os.FileMode(0644)
+
+	// watchReconnectDelay is how long watchKeyUntilCancelled and
+	// watchPrefixUntilCancelled wait before re-establishing a watch
+	// that ended unexpectedly (e.g. after a CONNECTIONDOWN event), so
+	// a transient network blip doesn't permanently stop a template
+	// from ever re-rendering again.
+	watchReconnectDelay = 1 * time.Second
+)
+
+// TemplateConfig describes a single template kept rendered against
+// live data from a Store
+type TemplateConfig struct {
+	Source      string        // path to the template source file
+	Destination string        // path the rendered output is atomically written to
+	Command     string        // optional "sh -c" command run after a successful render
+	Perms       os.FileMode   // destination file mode, defaults to 0644
+	LeftDelim   string        // template left delimiter, defaults to "{{"
+	RightDelim  string        // template right delimiter, defaults to "}}"
+	MinDelay    time.Duration // quiescence lower bound, defaults to 150ms
+	MaxDelay    time.Duration // quiescence upper bound, defaults to 5s
+}
+
+func (cfg *TemplateConfig) applyDefaults() {
+	if cfg.LeftDelim == "" {
+		cfg.LeftDelim = "{{"
+	}
+	if cfg.RightDelim == "" {
+		cfg.RightDelim = "}}"
+	}
+	if cfg.Perms == 0 {
+		cfg.Perms = defaultPerms
+	}
+	if cfg.MinDelay == 0 {
+		cfg.MinDelay = defaultMinDelay
+	}
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = defaultMaxDelay
+	}
+}
+
+// watchedTemplate is a registered TemplateConfig along with the
+// plumbing needed to tear its watches down
+type watchedTemplate struct {
+	cfg    TemplateConfig
+	tmpl   *template.Template
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Manager renders a set of TemplateConfigs whenever the Store keys
+// or prefixes they reference change, coalescing bursts of changes
+// into a single render
+type Manager struct {
+	store store.Store
+
+	mu        sync.Mutex
+	templates map[string]*watchedTemplate
+}
+
+// NewManager returns a Manager that renders templates from data read
+// out of s
+func NewManager(s store.Store) *Manager {
+	return &Manager{
+		store:     s,
+		templates: make(map[string]*watchedTemplate),
+	}
+}
+
+// Register parses cfg.Source, discovers the keys and prefixes it
+// references by walking the parsed template for key/ls/tree calls,
+// opens a watch for each and renders cfg.Destination whenever any of
+// them change. The returned error only covers the initial parse;
+// render failures are logged.
+func (m *Manager) Register(ctx context.Context, cfg TemplateConfig) error {
+	cfg.applyDefaults()
+
+	raw, err := os.ReadFile(cfg.Source)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(filepath.Base(cfg.Source)).
+		Delims(cfg.LeftDelim, cfg.RightDelim).
+		Funcs(m.funcMap()).
+		Parse(string(raw))
+	if err != nil {
+		return err
+	}
+
+	keys, prefixes := discoverRefs(tmpl)
+
+	ctx, cancel := context.WithCancel(ctx)
+	wt := &watchedTemplate{cfg: cfg, tmpl: tmpl, cancel: cancel, done: make(chan struct{})}
+
+	m.mu.Lock()
+	if old, ok := m.templates[cfg.Destination]; ok {
+		old.cancel()
+	}
+	m.templates[cfg.Destination] = wt
+	m.mu.Unlock()
+
+	changed := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	for _, key := range keys {
+		key := key
+		go m.watchKeyUntilCancelled(ctx, key, trigger)
+	}
+	for _, prefix := range prefixes {
+		prefix := prefix
+		go m.watchPrefixUntilCancelled(ctx, prefix, trigger)
+	}
+
+	go m.debounceAndRender(ctx, wt, changed)
+
+	// Render once up front so Destination exists before the first change
+	trigger()
+
+	return nil
+}
+
+// watchKeyUntilCancelled keeps a watch on key alive for the lifetime
+// of ctx, re-establishing it after watchReconnectDelay whenever it
+// ends on its own (CONNECTIONDOWN, a dropped connection, ...) instead
+// of leaving the key unwatched after a transient blip.
+func (m *Manager) watchKeyUntilCancelled(ctx context.Context, key string, trigger func()) {
+	for ctx.Err() == nil {
+		if err := m.store.WatchCtx(ctx, key, 0, func([][]byte) { trigger() }); err != nil && ctx.Err() == nil {
+			log.WithField("name", "template").Errorf("Watch on key %s ended, reconnecting: %v", key, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-time.After(watchReconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchPrefixUntilCancelled is the WatchRangeCtx equivalent of
+// watchKeyUntilCancelled
+func (m *Manager) watchPrefixUntilCancelled(ctx context.Context, prefix string, trigger func()) {
+	for ctx.Err() == nil {
+		if err := m.store.WatchRangeCtx(ctx, prefix, "", 0, func([][]byte) { trigger() }); err != nil && ctx.Err() == nil {
+			log.WithField("name", "template").Errorf("Watch on prefix %s ended, reconnecting: %v", prefix, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-time.After(watchReconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// debounceAndRender coalesces a burst of key changes into a single
+// render: it waits for MinDelay of silence since the last change, but
+// never delays a render past MaxDelay since the burst started
+func (m *Manager) debounceAndRender(ctx context.Context, wt *watchedTemplate, changed <-chan struct{}) {
+	defer close(wt.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+
+		min := time.NewTimer(wt.cfg.MinDelay)
+		max := time.NewTimer(wt.cfg.MaxDelay)
+
+	debounce:
+		for {
+			select {
+			case <-ctx.Done():
+				min.Stop()
+				max.Stop()
+				return
+			case <-changed:
+				if !min.Stop() {
+					<-min.C
+				}
+				min.Reset(wt.cfg.MinDelay)
+			case <-min.C:
+				max.Stop()
+				break debounce
+			case <-max.C:
+				min.Stop()
+				break debounce
+			}
+		}
+
+		if err := m.render(wt); err != nil {
+			log.WithField("name", "template").Errorf("Failed to render %s: %v", wt.cfg.Destination, err)
+		}
+	}
+}
+
+// render executes the template and writes it to cfg.Destination
+// atomically: write to a temp file in the same directory, fsync,
+// rename into place, then optionally exec the reload command
+func (m *Manager) render(wt *watchedTemplate) error {
+	var buf bytes.Buffer
+	if err := wt.tmpl.Execute(&buf, nil); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(wt.cfg.Destination)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(wt.cfg.Destination)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), wt.cfg.Perms); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), wt.cfg.Destination); err != nil {
+		return err
+	}
+
+	if wt.cfg.Command == "" {
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", wt.cfg.Command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Stop tears down every registered template's watches and waits for
+// their render goroutines to exit
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	templates := make([]*watchedTemplate, 0, len(m.templates))
+	for _, wt := range m.templates {
+		templates = append(templates, wt)
+	}
+	m.templates = make(map[string]*watchedTemplate)
+	m.mu.Unlock()
+
+	for _, wt := range templates {
+		wt.cancel()
+		<-wt.done
+	}
+}
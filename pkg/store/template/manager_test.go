@@ -0,0 +1,120 @@
+package template
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestRenderWritesAtomicallyWithPerms(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "out.conf")
+
+	tmpl, err := template.New("t").Parse("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt := &watchedTemplate{
+		cfg:  TemplateConfig{Destination: dest, Perms: 0640},
+		tmpl: tmpl,
+	}
+
+	m := &Manager{}
+	if err := m.render(wt); err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("rendered content = %q, want %q", data, "hello world")
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("perms = %v, want 0640", info.Mode().Perm())
+	}
+
+	// No temp file should be left behind next to the destination.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir has %d entries, want 1 (just the rendered destination)", len(entries))
+	}
+}
+
+func TestDebounceAndRenderCoalescesBurst(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "out.conf")
+
+	var renders int32
+	tmpl, err := template.New("t").Funcs(template.FuncMap{
+		"count": func() string {
+			atomic.AddInt32(&renders, 1)
+			return ""
+		},
+	}).Parse("{{ count }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt := &watchedTemplate{
+		cfg: TemplateConfig{
+			Destination: dest,
+			Perms:       defaultPerms,
+			MinDelay:    60 * time.Millisecond,
+			MaxDelay:    2 * time.Second,
+		},
+		tmpl: tmpl,
+		done: make(chan struct{}),
+	}
+
+	m := &Manager{}
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+	go m.debounceAndRender(ctx, wt, changed)
+
+	trigger := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	// A burst of rapid changes, each well within MinDelay of the
+	// last, should coalesce into a single render.
+	for i := 0; i < 5; i++ {
+		trigger()
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := atomic.LoadInt32(&renders); got != 1 {
+		t.Fatalf("renders after burst = %d, want 1", got)
+	}
+
+	// A separate change after quiescence triggers a second render.
+	trigger()
+	time.Sleep(300 * time.Millisecond)
+	if got := atomic.LoadInt32(&renders); got != 2 {
+		t.Fatalf("renders after second change = %d, want 2", got)
+	}
+
+	cancel()
+	select {
+	case <-wt.done:
+	case <-time.After(time.Second):
+		t.Fatal("debounceAndRender did not exit after context cancellation")
+	}
+}